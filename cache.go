@@ -0,0 +1,299 @@
+package doh
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxNegativeTTL is used by CachingClient when MaxNegativeTTL is
+// unset.
+const defaultMaxNegativeTTL = 5 * time.Minute
+
+// CacheMetrics receives hit/miss events from a CachingClient, allowing
+// callers to plug in their own metrics library without this package
+// depending on one.
+type CacheMetrics interface {
+	CacheHit(name string, rrtype RecordType)
+	CacheMiss(name string, rrtype RecordType)
+}
+
+// CachingClient wraps a Client with a TTL-aware response cache. Positive
+// answers expire with the minimum TTL of their Answer records; negative
+// answers (NXDOMAIN, or SERVFAIL with no records) are cached using the SOA
+// MINIMUM field per RFC 2308. Concurrent identical queries are coalesced so
+// only one reaches Client.
+type CachingClient struct {
+	// Client executes queries that miss the cache.
+	Client *Client
+
+	// MaxEntries bounds the number of cached answers kept in memory. Zero
+	// means unbounded.
+	MaxEntries int
+
+	// MaxNegativeTTL caps how long a negative response is cached for.
+	// Defaults to 5 minutes.
+	MaxNegativeTTL time.Duration
+
+	// Metrics, if set, is notified of every cache hit and miss.
+	Metrics CacheMetrics
+
+	mu       sync.Mutex
+	entries  map[cacheKey]*list.Element
+	order    *list.List // most-recently-used at the front
+	inflight map[cacheKey]*cacheCall
+}
+
+type cacheKey struct {
+	name             string
+	rrtype           RecordType
+	disableDNSSEC    bool
+	ednsClientSubnet string
+}
+
+func cacheKeyFor(q *Question) cacheKey {
+	return cacheKey{
+		name:             FQDN(q.Name),
+		rrtype:           q.Type,
+		disableDNSSEC:    q.DisableDNSSEC,
+		ednsClientSubnet: q.EDNSClientSubnet,
+	}
+}
+
+type cacheEntry struct {
+	key        cacheKey
+	answer     *Answer
+	insertedAt time.Time
+	expires    time.Time
+}
+
+// cacheCall coalesces concurrent identical queries (singleflight).
+type cacheCall struct {
+	done   chan struct{}
+	answer *Answer
+	rtt    time.Duration
+	err    error
+}
+
+// Do executes q, returning a cached Answer if a live one is available,
+// otherwise querying through to Client and caching the result.
+func (c *CachingClient) Do(q *Question) (*Answer, time.Duration, error) {
+	key := cacheKeyFor(q)
+
+	if answer, ok := c.get(key); ok {
+		if c.Metrics != nil {
+			c.Metrics.CacheHit(key.name, key.rrtype)
+		}
+
+		return answer, 0, nil
+	}
+
+	if c.Metrics != nil {
+		c.Metrics.CacheMiss(key.name, key.rrtype)
+	}
+
+	return c.doSingleflight(key, q)
+}
+
+func (c *CachingClient) doSingleflight(key cacheKey, q *Question) (*Answer, time.Duration, error) {
+	c.mu.Lock()
+	if c.inflight == nil {
+		c.inflight = make(map[cacheKey]*cacheCall)
+	}
+
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.answer, call.rtt, call.err
+	}
+
+	call := &cacheCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	call.answer, call.rtt, call.err = c.Client.Do(q)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+
+	close(call.done)
+
+	if call.err == nil {
+		c.set(key, call.answer)
+	}
+
+	return call.answer, call.rtt, call.err
+}
+
+func (c *CachingClient) get(key cacheKey) (*Answer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*cacheEntry)
+
+	elapsed := time.Since(entry.insertedAt)
+	if !time.Now().Before(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+
+	return decrementTTLs(entry.answer, elapsed), true
+}
+
+func (c *CachingClient) set(key cacheKey, answer *Answer) {
+	if answer == nil {
+		return
+	}
+
+	ttl, ok := cacheTTL(answer, c.maxNegativeTTL())
+	if !ok || ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[cacheKey]*list.Element)
+		c.order = list.New()
+	}
+
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+
+	now := time.Now()
+	el := c.order.PushFront(&cacheEntry{
+		key:        key,
+		answer:     answer,
+		insertedAt: now,
+		expires:    now.Add(ttl),
+	})
+	c.entries[key] = el
+
+	if c.MaxEntries > 0 {
+		for c.order.Len() > c.MaxEntries {
+			oldest := c.order.Back()
+			if oldest == nil {
+				break
+			}
+
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*cacheEntry).key)
+		}
+	}
+}
+
+// Purge removes any cached entries for name. If rrtype is zero, entries for
+// every record type of name are removed.
+func (c *CachingClient) Purge(name string, rrtype RecordType) {
+	name = FQDN(name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, el := range c.entries {
+		if key.name != name {
+			continue
+		}
+
+		if rrtype != 0 && key.rrtype != rrtype {
+			continue
+		}
+
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func (c *CachingClient) maxNegativeTTL() time.Duration {
+	if c.MaxNegativeTTL > 0 {
+		return c.MaxNegativeTTL
+	}
+
+	return defaultMaxNegativeTTL
+}
+
+// cacheTTL returns how long answer may be cached for, and whether it is
+// cacheable at all.
+func cacheTTL(answer *Answer, maxNegative time.Duration) (time.Duration, bool) {
+	if answer.Status == Success && len(answer.Answer) > 0 {
+		min := -1
+		for _, r := range answer.Answer {
+			if min < 0 || r.TTL < min {
+				min = r.TTL
+			}
+		}
+
+		if min < 0 {
+			min = 0
+		}
+
+		return time.Duration(min) * time.Second, true
+	}
+
+	if answer.Status == NameError || (answer.Status == ServerFailure && len(answer.Answer) == 0) {
+		for _, r := range answer.Authority {
+			if r.Type != SOA {
+				continue
+			}
+
+			fields := strings.Fields(r.Data)
+			if len(fields) == 0 {
+				continue
+			}
+
+			min, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				continue
+			}
+
+			ttl := time.Duration(min) * time.Second
+			if maxNegative > 0 && ttl > maxNegative {
+				ttl = maxNegative
+			}
+
+			return ttl, true
+		}
+	}
+
+	return 0, false
+}
+
+// decrementTTLs returns a copy of answer with every Answer record's TTL
+// reduced by elapsed, so callers observe monotonically decreasing TTLs as a
+// cached entry ages.
+func decrementTTLs(answer *Answer, elapsed time.Duration) *Answer {
+	out := *answer
+
+	if len(answer.Answer) == 0 {
+		return &out
+	}
+
+	sec := int(elapsed / time.Second)
+
+	out.Answer = make(Records, len(answer.Answer))
+	for i, r := range answer.Answer {
+		rc := *r
+		rc.TTL -= sec
+		if rc.TTL < 0 {
+			rc.TTL = 0
+		}
+
+		out.Answer[i] = &rc
+	}
+
+	return &out
+}
@@ -0,0 +1,88 @@
+package doh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheTTL(t *testing.T) {
+	ttl, ok := cacheTTL(&Answer{
+		Status: Success,
+		Answer: Records{
+			&Record{Name: "example.org.", Type: A, TTL: 300, Data: "93.184.216.34"},
+			&Record{Name: "example.org.", Type: A, TTL: 60, Data: "93.184.216.35"},
+		},
+	}, 5*time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, 60*time.Second, ttl)
+
+	ttl, ok = cacheTTL(&Answer{
+		Status: NameError,
+		Authority: Records{
+			&Record{
+				Name: "example.org.",
+				Type: SOA,
+				TTL:  3600,
+				Data: "ns1.example.org. hostmaster.example.org. 1 7200 3600 1209600 90",
+			},
+		},
+	}, 5*time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, 90*time.Second, ttl)
+
+	ttl, ok = cacheTTL(&Answer{
+		Status: NameError,
+		Authority: Records{
+			&Record{
+				Name: "example.org.",
+				Type: SOA,
+				TTL:  3600,
+				Data: "ns1.example.org. hostmaster.example.org. 1 7200 3600 1209600 7200",
+			},
+		},
+	}, 5*time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Minute, ttl)
+
+	_, ok = cacheTTL(&Answer{Status: Refused}, 5*time.Minute)
+	assert.False(t, ok)
+}
+
+func TestDecrementTTLs(t *testing.T) {
+	answer := decrementTTLs(&Answer{
+		Status: Success,
+		Answer: Records{
+			&Record{Name: "example.org.", Type: A, TTL: 300, Data: "93.184.216.34"},
+		},
+	}, 60*time.Second)
+
+	assert.Equal(t, 240, answer.Answer[0].TTL)
+
+	answer = decrementTTLs(&Answer{
+		Status: Success,
+		Answer: Records{
+			&Record{Name: "example.org.", Type: A, TTL: 30, Data: "93.184.216.34"},
+		},
+	}, 60*time.Second)
+
+	assert.Equal(t, 0, answer.Answer[0].TTL)
+}
+
+func TestCachingClientPurge(t *testing.T) {
+	c := &CachingClient{}
+
+	c.set(cacheKey{name: "example.org.", rrtype: A}, &Answer{
+		Status: Success,
+		Answer: Records{&Record{Name: "example.org.", Type: A, TTL: 300, Data: "93.184.216.34"}},
+	})
+
+	_, ok := c.get(cacheKey{name: "example.org.", rrtype: A})
+	assert.True(t, ok)
+
+	c.Purge("example.org", A)
+
+	_, ok = c.get(cacheKey{name: "example.org.", rrtype: A})
+	assert.False(t, ok)
+}
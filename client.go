@@ -1,11 +1,16 @@
 package doh
 
 import (
+	"bytes"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 // UserAgent is the HTTP User-Agent header given to the remote server.
@@ -23,6 +28,17 @@ type Client struct {
 
 	// AllowHTTP allows questions to be sent without HTTPS.
 	AllowHTTP bool
+
+	// Format selects the wire encoding used to speak to Addr. Defaults to
+	// JSONFormat for backwards compatibility with the legacy
+	// application/dns-json protocol; set to WireFormat to speak the
+	// standardized RFC 8484 application/dns-message protocol instead.
+	Format Format
+
+	// WireGET sends WireFormat queries as a GET request with the message
+	// base64url-encoded in the `dns` query parameter, as described by RFC
+	// 8484 section 4.1, instead of the default POST with a binary body.
+	WireGET bool
 }
 
 // DefaultClient uses Google DNS and http.DefaultClient
@@ -56,6 +72,11 @@ func (c *Client) Do(q *Question) (res *Answer, rtt time.Duration, err error) {
 		c.HTTPClient = http.DefaultClient
 	}
 
+	if c.Format == WireFormat {
+		res, err = c.doWire(q)
+		return
+	}
+
 	r := &http.Request{
 		Method: http.MethodGet,
 		URL: &url.URL{
@@ -107,6 +128,85 @@ func Do(q *Question) (*Answer, time.Duration, error) {
 	return DefaultClient.Do(q)
 }
 
+// doWire executes q against the configured server using the RFC 8484
+// application/dns-message protocol.
+func (c *Client) doWire(q *Question) (*Answer, error) {
+	return c.doWireMsg(MessageFromQuestion(q))
+}
+
+// doWireMsg executes a pre-built wire message against the configured
+// server, for callers (such as Validator) that need control over the
+// outgoing message beyond what MessageFromQuestion provides.
+func (c *Client) doWireMsg(m *dns.Msg) (*Answer, error) {
+	body, err := m.Pack()
+	if err != nil {
+		return nil, &ClientError{msg: "could not encode query", err: err}
+	}
+
+	var r *http.Request
+
+	if c.WireGET {
+		r = &http.Request{
+			Method: http.MethodGet,
+			URL: &url.URL{
+				Scheme:   c.Addr.Scheme,
+				User:     c.Addr.User,
+				Host:     c.Addr.Host,
+				Path:     c.Addr.Path,
+				RawQuery: url.Values{"dns": {base64.RawURLEncoding.EncodeToString(body)}}.Encode(),
+			},
+			Header: http.Header{
+				"Accept":     {mimeDNSMessage},
+				"User-Agent": {UserAgent},
+			},
+			Host: c.Addr.Host,
+		}
+	} else {
+		r = &http.Request{
+			Method: http.MethodPost,
+			URL: &url.URL{
+				Scheme: c.Addr.Scheme,
+				User:   c.Addr.User,
+				Host:   c.Addr.Host,
+				Path:   c.Addr.Path,
+			},
+			Header: http.Header{
+				"Accept":       {mimeDNSMessage},
+				"Content-Type": {mimeDNSMessage},
+				"User-Agent":   {UserAgent},
+			},
+			Host: c.Addr.Host,
+			Body: ioutil.NopCloser(bytes.NewReader(body)),
+		}
+	}
+
+	w, err := c.HTTPClient.Do(r)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil, &ClientError{msg: "server timeout", err: err}
+		}
+
+		return nil, err
+	}
+	defer w.Body.Close()
+
+	if w.StatusCode != http.StatusOK {
+		return nil, HTTPError(w.StatusCode)
+	}
+
+	raw, err := ioutil.ReadAll(w.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(raw); err != nil {
+		return nil, &ClientError{msg: "could not decode reply", err: err}
+	}
+
+	return AnswerFromMessage(reply), nil
+}
+
 // ClientError is returned when there is an error creating a Question or
 // connecting to an upstream server.
 type ClientError struct {
@@ -0,0 +1,45 @@
+package doh
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestClientWireGET checks that Client.WireGET round-trips a query against
+// Server's GET (?dns=) wire-format path, the half of RFC 8484 that POST
+// alone can't exercise.
+func TestClientWireGET(t *testing.T) {
+	srv := &Server{
+		Handler: HandlerFunc(func(q *Question) *Answer {
+			return &Answer{
+				Status: Success,
+				Answer: Records{{Name: q.Name, Type: A, TTL: 300, Data: "93.184.216.34"}},
+			}
+		}),
+		AllowHTTP: true,
+	}
+
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	addr, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	c := &Client{
+		Addr:       addr,
+		AllowHTTP:  true,
+		Format:     WireFormat,
+		WireGET:    true,
+		HTTPClient: http.DefaultClient,
+	}
+
+	res, _, err := c.Do(&Question{Name: "example.org.", Type: A})
+	require.NoError(t, err)
+	require.NotNil(t, res)
+	require.Len(t, res.Answer, 1)
+	require.Equal(t, "93.184.216.34", res.Answer[0].Data)
+}
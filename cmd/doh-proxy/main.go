@@ -0,0 +1,81 @@
+// Command doh-proxy is a classic DNS-to-DoH stub resolver. It listens for
+// plain UDP/TCP DNS queries and forwards them to one or more
+// DNS-over-HTTPS upstreams.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jamescun/doh"
+	"github.com/jamescun/doh/dohproxy"
+)
+
+// upstreamList is a repeatable -upstream flag of DoH server URLs.
+type upstreamList []string
+
+func (u *upstreamList) String() string {
+	return strings.Join(*u, ",")
+}
+
+func (u *upstreamList) Set(value string) error {
+	*u = append(*u, value)
+	return nil
+}
+
+// command-line flags
+var (
+	Listen    = flag.String("listen", ":53", "address to listen for DNS queries on")
+	Upstreams upstreamList
+	Timeout   = flag.Duration("timeout", 5*time.Second, "per-query upstream timeout")
+	AllowHTTP = flag.Bool("allow-http", false, "allow upstream queries over HTTP")
+)
+
+func main() {
+	flag.Var(&Upstreams, "upstream", "url of a dns-over-https upstream (repeatable)")
+	flag.Parse()
+
+	if len(Upstreams) == 0 {
+		Upstreams = upstreamList{"https://dns.google.com/resolve"}
+	}
+
+	proxy := &dohproxy.Proxy{
+		Timeout: *Timeout,
+	}
+
+	for _, u := range Upstreams {
+		addr, err := url.Parse(u)
+		if err != nil {
+			configError("invalid upstream %q: %s", u, err)
+		}
+
+		proxy.Upstreams = append(proxy.Upstreams, &dohproxy.Upstream{
+			Client: &doh.Client{
+				Addr:       addr,
+				HTTPClient: http.DefaultClient,
+				AllowHTTP:  *AllowHTTP,
+			},
+		})
+	}
+
+	fmt.Printf("doh-proxy: listening on %s, forwarding to %d upstream(s)\n", *Listen, len(proxy.Upstreams))
+
+	if err := proxy.ListenAndServe(*Listen); err != nil {
+		runtimeError("could not listen: %s", err)
+	}
+}
+
+func configError(format string, args ...interface{}) {
+	fmt.Printf("config error: "+format+"\n", args...)
+	os.Exit(2)
+}
+
+func runtimeError(format string, args ...interface{}) {
+	fmt.Printf("runtime error: "+format+"\n", args...)
+	os.Exit(1)
+}
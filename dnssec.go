@@ -0,0 +1,616 @@
+package doh
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rootTrustAnchor is the IANA root zone Key Signing Key trust anchor
+// (KSK-2017). https://data.iana.org/root-anchors/root-anchors.xml
+var rootTrustAnchor = TrustAnchor{
+	Name:       ".",
+	KeyTag:     20326,
+	Algorithm:  dns.RSASHA256,
+	DigestType: dns.SHA256,
+	Digest:     "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+}
+
+// TrustAnchor is a DS record a Validator trusts implicitly, used as the root
+// of the DNSSEC chain of trust.
+type TrustAnchor struct {
+	Name       string
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     string
+}
+
+// ValidationError is returned by Validator when a response fails DNSSEC
+// validation, distinguishing "upstream lied" (or was tampered with in
+// transit) from a network or protocol error.
+type ValidationError struct {
+	// Name is the name whose validation failed, if known.
+	Name string
+
+	msg string
+	err error
+}
+
+func (ve *ValidationError) Error() string {
+	if ve.err != nil {
+		return "dnssec: " + ve.msg + ": " + ve.err.Error()
+	}
+
+	return "dnssec: " + ve.msg
+}
+
+// Cause returns the root cause error, or nil if not configured.
+func (ve *ValidationError) Cause() error {
+	return ve.err
+}
+
+// Validator wraps a Client, independently verifying the DNSSEC chain of
+// trust for its responses rather than trusting the upstream's AD bit
+// verbatim. It always speaks RFC 8484 wire format to Client's upstream, as
+// that is the only format that reliably carries raw RRSIG signature data.
+//
+// Validation covers RSASHA256, ECDSAP256SHA256 and ED25519 signed RRsets (as
+// implemented by github.com/miekg/dns), recursing the DS -> DNSKEY chain up
+// to TrustAnchor and caching validated keys per zone.
+type Validator struct {
+	// Client executes queries, both the one being validated and any
+	// DNSKEY/DS lookups needed to build the chain of trust.
+	Client *Client
+
+	// TrustAnchor is the root of the chain of trust. Defaults to the IANA
+	// root zone KSK-2017.
+	TrustAnchor TrustAnchor
+
+	mu   sync.Mutex
+	keys map[string][]*dns.DNSKEY
+}
+
+// Do executes q via Client, then independently validates the DNSSEC chain
+// covering the response before returning it. A *ValidationError is returned
+// if validation fails.
+func (v *Validator) Do(q *Question) (res *Answer, rtt time.Duration, err error) {
+	t1 := time.Now()
+	defer func() {
+		rtt = time.Now().Sub(t1)
+	}()
+
+	if v.Client == nil {
+		err = &ClientError{msg: "no client configured"}
+		return
+	}
+
+	if v.Client.HTTPClient == nil {
+		v.Client.HTTPClient = http.DefaultClient
+	}
+
+	res, err = v.Client.doWireMsg(validatingMessage(q))
+	if err != nil {
+		return
+	}
+
+	if verr := v.validate(q, res); verr != nil {
+		res = nil
+		err = verr
+	}
+
+	return
+}
+
+func (v *Validator) trustAnchor() TrustAnchor {
+	if v.TrustAnchor.Name != "" {
+		return v.TrustAnchor
+	}
+
+	return rootTrustAnchor
+}
+
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+func (v *Validator) validate(q *Question, answer *Answer) error {
+	if len(answer.Answer) == 0 {
+		return v.validateNegative(q, answer)
+	}
+
+	rrs := rrsFromRecords(answer.Answer)
+
+	groups := map[rrsetKey][]dns.RR{}
+	var order []rrsetKey
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+
+		k := rrsetKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if _, ok := groups[k]; !ok {
+			order = append(order, k)
+		}
+
+		groups[k] = append(groups[k], rr)
+	}
+
+	sigs := rrsigsByTypeCovered(append(rrs, rrsFromRecords(answer.Additional)...))
+
+	for _, k := range order {
+		covering := sigs[k.rrtype]
+		if len(covering) == 0 {
+			return &ValidationError{Name: k.name, msg: "no RRSIG covers RRset"}
+		}
+
+		if err := v.verifyRRset(k.name, groups[k], covering); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateNegative checks that any NSEC/NSEC3 denial-of-existence records
+// returned with an empty or NXDOMAIN answer are authentically signed, and
+// that they actually prove the non-existence (or NODATA) of the queried
+// name, per RFC 4035 section 5.4 and RFC 5155 section 8.
+func (v *Validator) validateNegative(q *Question, answer *Answer) error {
+	rrs := rrsFromRecords(answer.Authority)
+
+	byType := map[uint16][]dns.RR{}
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3, dns.TypeSOA:
+			byType[rr.Header().Rrtype] = append(byType[rr.Header().Rrtype], rr)
+		}
+	}
+
+	if len(byType) == 0 {
+		return &ValidationError{msg: "no NSEC/NSEC3 denial-of-existence records in response"}
+	}
+
+	sigs := rrsigsByTypeCovered(rrs)
+
+	for rrtype, set := range byType {
+		covering := sigs[rrtype]
+		if len(covering) == 0 {
+			return &ValidationError{Name: set[0].Header().Name, msg: "no RRSIG covers denial-of-existence record"}
+		}
+
+		if err := v.verifyRRset(set[0].Header().Name, set, covering); err != nil {
+			return err
+		}
+	}
+
+	var nsecs []dns.RR
+	nsecs = append(nsecs, byType[dns.TypeNSEC]...)
+	nsecs = append(nsecs, byType[dns.TypeNSEC3]...)
+
+	if len(nsecs) == 0 {
+		return &ValidationError{Name: q.Name, msg: "no NSEC/NSEC3 record to prove denial of existence"}
+	}
+
+	name := strings.ToLower(dns.Fqdn(q.Name))
+
+	if answer.Status == NameError {
+		return proveNameError(name, nsecs)
+	}
+
+	return proveNoData(name, uint16(q.Type), nsecs)
+}
+
+// proveNameError checks that nsecs constitute a full RFC 4035/5155 proof
+// that name does not exist: one record must cover name itself (no exact
+// owner matches it), and another must cover the wildcard at name's closest
+// encloser (so no wildcard could have synthesized an answer either).
+func proveNameError(name string, nsecs []dns.RR) error {
+	covered := false
+	for _, rr := range nsecs {
+		if recordCovers(rr, name) {
+			covered = true
+			break
+		}
+	}
+
+	if !covered {
+		return &ValidationError{Name: name, msg: "no NSEC/NSEC3 record covers the queried name"}
+	}
+
+	encloser, ok := closestEncloser(name, nsecs)
+	if !ok {
+		return &ValidationError{Name: name, msg: "could not establish a closest encloser for wildcard denial"}
+	}
+
+	wildcard := "*." + encloser
+
+	for _, rr := range nsecs {
+		if recordCovers(rr, wildcard) {
+			return nil
+		}
+	}
+
+	return &ValidationError{Name: name, msg: "no NSEC/NSEC3 record covers the wildcard at the closest encloser"}
+}
+
+// proveNoData checks that one of nsecs matches name exactly and its type
+// bitmap omits qtype, proving the name exists but the requested RRset does
+// not (RFC 4035 section 5.4, RFC 5155 section 8.5).
+func proveNoData(name string, qtype uint16, nsecs []dns.RR) error {
+	for _, rr := range nsecs {
+		if !recordMatches(rr, name) {
+			continue
+		}
+
+		if typeBitmapHas(rr, qtype) {
+			return &ValidationError{Name: name, msg: "NSEC/NSEC3 record asserts the queried type exists"}
+		}
+
+		return nil
+	}
+
+	return &ValidationError{Name: name, msg: "no NSEC/NSEC3 record matches the queried name"}
+}
+
+// closestEncloser returns the longest ancestor of name (including the zone
+// apex) that is matched by one of nsecs, per RFC 5155 section 8.3.
+func closestEncloser(name string, nsecs []dns.RR) (string, bool) {
+	labels := dns.SplitDomainName(strings.ToLower(dns.Fqdn(name)))
+
+	for i := 1; i <= len(labels); i++ {
+		candidate := dns.Fqdn(strings.Join(labels[i:], "."))
+
+		for _, rr := range nsecs {
+			if recordMatches(rr, candidate) {
+				return candidate, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// recordCovers reports whether the NSEC/NSEC3 record rr's owner..next-owner
+// interval covers name, meaning no record named exactly name exists.
+func recordCovers(rr dns.RR, name string) bool {
+	switch t := rr.(type) {
+	case *dns.NSEC:
+		return nsecCovers(t, name)
+	case *dns.NSEC3:
+		return t.Cover(name)
+	default:
+		return false
+	}
+}
+
+// recordMatches reports whether the NSEC/NSEC3 record rr is the one owned by
+// name exactly.
+func recordMatches(rr dns.RR, name string) bool {
+	switch t := rr.(type) {
+	case *dns.NSEC:
+		return strings.EqualFold(t.Header().Name, dns.Fqdn(name))
+	case *dns.NSEC3:
+		return t.Match(name)
+	default:
+		return false
+	}
+}
+
+// nsecCovers reports whether the classic NSEC record rr's owner..next-domain
+// interval covers name, in canonical DNS name order (RFC 4034 section 6.1).
+func nsecCovers(rr *dns.NSEC, name string) bool {
+	owner := strings.ToLower(rr.Header().Name)
+	next := strings.ToLower(rr.NextDomain)
+	name = strings.ToLower(dns.Fqdn(name))
+
+	if owner == next {
+		// the sole NSEC in the zone covers every other name
+		return name != owner
+	}
+
+	if canonicalLess(next, owner) {
+		// the last NSEC in the zone wraps back around to the apex
+		return canonicalLess(owner, name) || canonicalLess(name, next)
+	}
+
+	return canonicalLess(owner, name) && canonicalLess(name, next)
+}
+
+// canonicalLess reports whether a sorts strictly before b in canonical DNS
+// name order (RFC 4034 section 6.1): labels are compared from the least
+// significant (rightmost) to the most significant, and a name that is a
+// strict prefix of the other (i.e. has fewer labels) sorts first.
+func canonicalLess(a, b string) bool {
+	al := dns.SplitDomainName(strings.ToLower(dns.Fqdn(a)))
+	bl := dns.SplitDomainName(strings.ToLower(dns.Fqdn(b)))
+
+	for i := 1; i <= len(al) && i <= len(bl); i++ {
+		la, lb := al[len(al)-i], bl[len(bl)-i]
+		if la != lb {
+			return la < lb
+		}
+	}
+
+	return len(al) < len(bl)
+}
+
+// typeBitmapHas reports whether the NSEC/NSEC3 record rr's type bitmap
+// lists t as present at its owner name.
+func typeBitmapHas(rr dns.RR, t uint16) bool {
+	var bitmap []uint16
+
+	switch v := rr.(type) {
+	case *dns.NSEC:
+		bitmap = v.TypeBitMap
+	case *dns.NSEC3:
+		bitmap = v.TypeBitMap
+	default:
+		return false
+	}
+
+	for _, x := range bitmap {
+		if x == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+func rrsigsByTypeCovered(rrs []dns.RR) map[uint16][]*dns.RRSIG {
+	sigs := map[uint16][]*dns.RRSIG{}
+
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs[sig.TypeCovered] = append(sigs[sig.TypeCovered], sig)
+		}
+	}
+
+	return sigs
+}
+
+// verifyRRset verifies rrset is validly signed by at least one of sigs,
+// against a DNSKEY chained up to TrustAnchor.
+func (v *Validator) verifyRRset(name string, rrset []dns.RR, sigs []*dns.RRSIG) error {
+	var lastErr error
+
+	for _, sig := range sigs {
+		keys, err := v.keysFor(sig.SignerName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+
+			if err := sig.Verify(key, rrset); err == nil {
+				return nil
+			}
+		}
+	}
+
+	if lastErr != nil {
+		return &ValidationError{Name: name, msg: "could not build chain of trust", err: lastErr}
+	}
+
+	return &ValidationError{Name: name, msg: "no RRSIG validated against a trusted DNSKEY"}
+}
+
+// keysFor returns the validated DNSKEY set for zone, recursively resolving
+// and validating the DS -> DNSKEY chain up to TrustAnchor, caching
+// intermediate zones as it goes.
+func (v *Validator) keysFor(zone string) ([]*dns.DNSKEY, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+
+	v.mu.Lock()
+	keys, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok {
+		return keys, nil
+	}
+
+	ta := v.trustAnchor()
+
+	var ds []*dns.DS
+	if zone == strings.ToLower(dns.Fqdn(ta.Name)) {
+		ds = []*dns.DS{{
+			Hdr:        dns.RR_Header{Name: zone, Rrtype: dns.TypeDS},
+			KeyTag:     ta.KeyTag,
+			Algorithm:  ta.Algorithm,
+			DigestType: ta.DigestType,
+			Digest:     ta.Digest,
+		}}
+	} else {
+		var err error
+		ds, err = v.fetchDS(zone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keys, sigs, err := v.fetchDNSKEY(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		for _, d := range ds {
+			if key.KeyTag() == d.KeyTag && strings.EqualFold(key.ToDS(d.DigestType).Digest, d.Digest) {
+				trusted = append(trusted, key)
+			}
+		}
+	}
+
+	if len(trusted) == 0 {
+		return nil, &ValidationError{Name: zone, msg: "no DNSKEY matches DS record"}
+	}
+
+	rrset := make([]dns.RR, len(keys))
+	for i, key := range keys {
+		rrset[i] = key
+	}
+
+	validated := false
+	for _, sig := range sigs {
+		for _, key := range trusted {
+			if sig.KeyTag == key.KeyTag() && sig.Verify(key, rrset) == nil {
+				validated = true
+			}
+		}
+	}
+
+	if !validated {
+		return nil, &ValidationError{Name: zone, msg: "DNSKEY RRset not signed by a trusted key"}
+	}
+
+	v.mu.Lock()
+	if v.keys == nil {
+		v.keys = map[string][]*dns.DNSKEY{}
+	}
+	v.keys[zone] = keys
+	v.mu.Unlock()
+
+	return keys, nil
+}
+
+// validatingMessage builds the outgoing wire message for q with both CD
+// (checking disabled, so the upstream returns data without discarding
+// anything that fails its own validation) and DO (DNSSEC OK, so RRSIG,
+// DNSKEY and DS records are included) set, regardless of q.DisableDNSSEC.
+func validatingMessage(q *Question) *dns.Msg {
+	cd := Question{
+		Name:             q.Name,
+		Type:             q.Type,
+		DisableDNSSEC:    true,
+		EDNSClientSubnet: q.EDNSClientSubnet,
+	}
+
+	m := MessageFromQuestion(&cd)
+
+	for _, rr := range m.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			opt.SetDo(true)
+		}
+	}
+
+	if !hasOPT(m) {
+		o := new(dns.OPT)
+		o.Hdr.Name = "."
+		o.Hdr.Rrtype = dns.TypeOPT
+		o.SetUDPSize(dns.DefaultMsgSize)
+		o.SetDo(true)
+		m.Extra = append(m.Extra, o)
+	}
+
+	return m
+}
+
+func hasOPT(m *dns.Msg) bool {
+	for _, rr := range m.Extra {
+		if _, ok := rr.(*dns.OPT); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (v *Validator) fetchDNSKEY(zone string) ([]*dns.DNSKEY, []*dns.RRSIG, error) {
+	answer, err := v.Client.doWireMsg(validatingMessage(&Question{Name: zone, Type: DNSKEY}))
+	if err != nil {
+		return nil, nil, &ValidationError{Name: zone, msg: "could not fetch DNSKEY", err: err}
+	}
+
+	var keys []*dns.DNSKEY
+	var sigs []*dns.RRSIG
+
+	for _, rr := range rrsFromRecords(answer.Answer) {
+		switch t := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, t)
+		case *dns.RRSIG:
+			if t.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, t)
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil, &ValidationError{Name: zone, msg: "no DNSKEY record returned"}
+	}
+
+	return keys, sigs, nil
+}
+
+func (v *Validator) fetchDS(zone string) ([]*dns.DS, error) {
+	parentKeys, err := v.keysFor(parentZone(zone))
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := v.Client.doWireMsg(validatingMessage(&Question{Name: zone, Type: DS}))
+	if err != nil {
+		return nil, &ValidationError{Name: zone, msg: "could not fetch DS", err: err}
+	}
+
+	var ds []*dns.DS
+	var sigs []*dns.RRSIG
+
+	for _, rr := range rrsFromRecords(answer.Answer) {
+		switch t := rr.(type) {
+		case *dns.DS:
+			ds = append(ds, t)
+		case *dns.RRSIG:
+			if t.TypeCovered == dns.TypeDS {
+				sigs = append(sigs, t)
+			}
+		}
+	}
+
+	if len(ds) == 0 {
+		return nil, &ValidationError{Name: zone, msg: "no DS record returned"}
+	}
+
+	rrset := make([]dns.RR, len(ds))
+	for i, d := range ds {
+		rrset[i] = d
+	}
+
+	validated := false
+	for _, sig := range sigs {
+		for _, key := range parentKeys {
+			if sig.KeyTag == key.KeyTag() && sig.Verify(key, rrset) == nil {
+				validated = true
+			}
+		}
+	}
+
+	if !validated {
+		return nil, &ValidationError{Name: zone, msg: "DS RRset not signed by parent zone key"}
+	}
+
+	return ds, nil
+}
+
+func parentZone(zone string) string {
+	zone = dns.Fqdn(zone)
+	if zone == "." {
+		return "."
+	}
+
+	if i := strings.IndexByte(zone, '.'); i >= 0 {
+		return zone[i+1:]
+	}
+
+	return "."
+}
@@ -0,0 +1,232 @@
+package doh
+
+import (
+	"bytes"
+	"crypto"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRootTrustAnchorDigest guards against rootTrustAnchor.Digest being
+// truncated: it is independently recomputed from the published IANA
+// KSK-2017 public key and must match exactly, or every Validator.Do against
+// a root-anchored chain would fail to find a matching DNSKEY.
+func TestRootTrustAnchorDigest(t *testing.T) {
+	ksk2017 := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.RSASHA256,
+		PublicKey: "AwEAAaz/tAm8yTn4Mfeh5eyI96WSVexTBAvkMgJzkKTOiW1vkIbzxeF3+/4RgWOq7HrxRixHlFlExOLAJr5emLvN7SWXgnLh4+B5xQlNVz8Og8kvArMtNROxVQuCaSnIDdD5LKyWbRd2n9WGe2R8PzgCmr3EgVLrjyBxWezF0jLHwVN8efS3rCj/EWgvIWgb9tarpVUDK/b58Da+sqqls3eNbuv7pr+eoZG+SrDK6nWeL3c6H5Apxz7LjVc1uTIdsIXxuOLYA4/ilBmSVIzuDWfdRUfhHdY6+cn8HFRm+2hM8AnXGXws9555KrUB5qihylGa8subX2Nn6UwNR1AkUTV74bU=",
+	}
+
+	require.Equal(t, rootTrustAnchor.KeyTag, ksk2017.KeyTag())
+
+	ds := ksk2017.ToDS(rootTrustAnchor.DigestType)
+	require.Len(t, ds.Digest, 64, "a SHA-256 DS digest is 32 bytes (64 hex chars)")
+
+	assert.True(t, strings.EqualFold(ds.Digest, rootTrustAnchor.Digest),
+		"rootTrustAnchor.Digest %q does not match the DS computed from the KSK-2017 public key %q", rootTrustAnchor.Digest, ds.Digest)
+}
+
+func TestCanonicalLess(t *testing.T) {
+	// ordering taken from RFC 4034 Appendix B.
+	names := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"zABC.z.example.",
+	}
+
+	for i := 0; i < len(names)-1; i++ {
+		assert.True(t, canonicalLess(names[i], names[i+1]), "%q should sort before %q", names[i], names[i+1])
+		assert.False(t, canonicalLess(names[i+1], names[i]), "%q should not sort before %q", names[i+1], names[i])
+	}
+}
+
+func TestNSECCovers(t *testing.T) {
+	rr := &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeNSEC},
+		NextDomain: "z.example.",
+	}
+
+	assert.True(t, nsecCovers(rr, "b.example."))
+	assert.False(t, nsecCovers(rr, "a.example."))
+	assert.False(t, nsecCovers(rr, "zz.example."))
+
+	// last NSEC in the zone wraps back around to the apex
+	wrap := &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "z.example.", Rrtype: dns.TypeNSEC},
+		NextDomain: "example.",
+	}
+
+	assert.True(t, nsecCovers(wrap, "zz.example."))
+	assert.False(t, nsecCovers(wrap, "a.example.")) // between the apex and z.example., not in the wrap range
+	assert.False(t, nsecCovers(wrap, "z.example."))
+}
+
+func TestProveNameError(t *testing.T) {
+	nsecs := []dns.RR{
+		&dns.NSEC{Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeNSEC}, NextDomain: "c.example."},
+		&dns.NSEC{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeNSEC}, NextDomain: "a.example."},
+	}
+
+	// b.example. is covered by a.example...c.example., and the wildcard
+	// *.example. is covered by example....a.example.
+	assert.NoError(t, proveNameError("b.example.", nsecs))
+
+	// no record covers z.example. or its wildcard.
+	assert.Error(t, proveNameError("z.example.", nsecs))
+
+	// a signed NSEC for an unrelated name must not be accepted as proof.
+	unrelated := []dns.RR{
+		&dns.NSEC{Hdr: dns.RR_Header{Name: "other.example.", Rrtype: dns.TypeNSEC}, NextDomain: "other2.example."},
+	}
+	assert.Error(t, proveNameError("b.example.", unrelated))
+}
+
+func TestProveNoData(t *testing.T) {
+	nsecs := []dns.RR{
+		&dns.NSEC{
+			Hdr:        dns.RR_Header{Name: "www.example.", Rrtype: dns.TypeNSEC},
+			NextDomain: "z.example.",
+			TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG},
+		},
+	}
+
+	assert.NoError(t, proveNoData("www.example.", dns.TypeAAAA, nsecs))
+	assert.Error(t, proveNoData("www.example.", dns.TypeA, nsecs))
+	assert.Error(t, proveNoData("other.example.", dns.TypeA, nsecs))
+}
+
+// wireTransport serves pre-built wire-format DNS answers for the Validator
+// to exercise Client.doWireMsg without touching the network.
+type wireTransport struct {
+	dnskey []dns.RR
+	byName map[string][]dns.RR
+}
+
+func (wt *wireTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+
+	q := m.Question[0]
+	if q.Qtype == dns.TypeDNSKEY {
+		reply.Answer = wt.dnskey
+	} else {
+		reply.Answer = wt.byName[strings.ToLower(q.Name)]
+	}
+
+	packed, err := reply.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {mimeDNSMessage}},
+		Body:       io.NopCloser(bytes.NewReader(packed)),
+	}, nil
+}
+
+// TestValidatorDoSignedRRset builds a small self-signed zone and checks that
+// Validator.Do accepts an A record validly chained to its TrustAnchor.
+func TestValidatorDoSignedRRset(t *testing.T) {
+	const zone = "example.com."
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ED25519,
+	}
+
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+
+	now := time.Now()
+	inception := uint32(now.Add(-time.Hour).Unix())
+	expiration := uint32(now.Add(time.Hour).Unix())
+
+	keySig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: zone, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		Algorithm:  dns.ED25519,
+		KeyTag:     key.KeyTag(),
+		SignerName: zone,
+		Inception:  inception,
+		Expiration: expiration,
+	}
+	require.NoError(t, keySig.Sign(priv.(crypto.Signer), []dns.RR{key}))
+
+	a := &dns.A{
+		Hdr: dns.RR_Header{Name: "www." + zone, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("93.184.216.34"),
+	}
+	aSig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: "www." + zone, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+		Algorithm:  dns.ED25519,
+		KeyTag:     key.KeyTag(),
+		SignerName: zone,
+		Inception:  inception,
+		Expiration: expiration,
+	}
+	require.NoError(t, aSig.Sign(priv.(crypto.Signer), []dns.RR{a}))
+
+	ds := key.ToDS(dns.SHA256)
+
+	transport := &wireTransport{
+		dnskey: []dns.RR{key, keySig},
+		byName: map[string][]dns.RR{
+			"www.example.com.": {a, aSig},
+		},
+	}
+
+	v := &Validator{
+		Client: &Client{
+			Addr:       &url.URL{Scheme: "https", Host: "doh.example", Path: "/dns-query"},
+			Format:     WireFormat,
+			HTTPClient: &http.Client{Transport: transport},
+		},
+		TrustAnchor: TrustAnchor{
+			Name:       zone,
+			KeyTag:     key.KeyTag(),
+			Algorithm:  dns.ED25519,
+			DigestType: dns.SHA256,
+			Digest:     ds.Digest,
+		},
+	}
+
+	res, _, err := v.Do(&Question{Name: "www.example.com.", Type: A})
+	require.NoError(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, Success, res.Status)
+
+	// tampering with the answer after the fact must be caught.
+	a.A = net.ParseIP("10.0.0.1")
+	transport.byName["www.example.com."] = []dns.RR{a, aSig}
+
+	_, _, err = v.Do(&Question{Name: "www.example.com.", Type: A})
+	assert.Error(t, err)
+}
@@ -0,0 +1,167 @@
+// Package dohproxy implements a classic DNS-to-DoH stub resolver, letting
+// clients that only speak plain UDP/TCP DNS (resolv.conf nameservers,
+// container runtimes, legacy appliances) transparently use one or more
+// DNS-over-HTTPS upstreams.
+package dohproxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jamescun/doh"
+)
+
+// defaultFailThreshold is the number of consecutive failures before an
+// Upstream is taken out of rotation, if Proxy.FailThreshold is unset.
+const defaultFailThreshold = 3
+
+// defaultCoolDown is how long an unhealthy Upstream is skipped before being
+// retried, if Proxy.CoolDown is unset.
+const defaultCoolDown = 30 * time.Second
+
+// Upstream is a single DNS-over-HTTPS server a Proxy can forward queries to.
+type Upstream struct {
+	// Client queries this upstream.
+	Client *doh.Client
+
+	failures  int32
+	downUntil atomic.Value
+}
+
+func (u *Upstream) healthy() bool {
+	dt, ok := u.downUntil.Load().(time.Time)
+	return !ok || time.Now().After(dt)
+}
+
+func (u *Upstream) recordSuccess() {
+	atomic.StoreInt32(&u.failures, 0)
+}
+
+func (u *Upstream) recordFailure(threshold int, coolDown time.Duration) {
+	if atomic.AddInt32(&u.failures, 1) >= int32(threshold) {
+		u.downUntil.Store(time.Now().Add(coolDown))
+	}
+}
+
+// Proxy is a DNS-to-DoH stub resolver. It implements dns.Handler, answering
+// classic DNS queries by forwarding them to one of Upstreams over
+// DNS-over-HTTPS.
+type Proxy struct {
+	// Upstreams are the DNS-over-HTTPS servers queried, in priority order.
+	// The first healthy upstream is tried first; later ones are only used
+	// on failure of those before them.
+	Upstreams []*Upstream
+
+	// Timeout bounds how long a single upstream query may take before it
+	// is considered failed and the next upstream is tried. Zero disables
+	// the timeout, deferring entirely to Client.HTTPClient.Timeout.
+	Timeout time.Duration
+
+	// FailThreshold is the number of consecutive failures before an
+	// upstream is taken out of rotation for CoolDown. Defaults to 3.
+	FailThreshold int
+
+	// CoolDown is how long a failed upstream is skipped before being
+	// retried. Defaults to 30s.
+	CoolDown time.Duration
+}
+
+// ListenAndServe starts a classic DNS resolver on addr, listening on both
+// UDP and TCP, and blocks until either listener returns an error.
+func (p *Proxy) ListenAndServe(addr string) error {
+	udp := &dns.Server{Addr: addr, Net: "udp", Handler: p}
+	tcp := &dns.Server{Addr: addr, Net: "tcp", Handler: p}
+
+	errs := make(chan error, 2)
+	go func() { errs <- udp.ListenAndServe() }()
+	go func() { errs <- tcp.ListenAndServe() }()
+
+	return <-errs
+}
+
+// ServeDNS implements github.com/miekg/dns.Handler.
+func (p *Proxy) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	defer w.Close()
+
+	if len(r.Question) == 0 {
+		dns.HandleFailed(w, r)
+		return
+	}
+
+	q := doh.QuestionFromMessage(r)
+
+	reply, err := p.query(&q)
+	if err != nil {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+
+	reply.Id = r.Id
+	w.WriteMsg(reply)
+}
+
+func (p *Proxy) query(q *doh.Question) (*dns.Msg, error) {
+	threshold := p.FailThreshold
+	if threshold <= 0 {
+		threshold = defaultFailThreshold
+	}
+
+	coolDown := p.CoolDown
+	if coolDown <= 0 {
+		coolDown = defaultCoolDown
+	}
+
+	var lastErr error
+
+	for _, u := range p.Upstreams {
+		if !u.healthy() {
+			continue
+		}
+
+		answer, _, err := p.doClient(u.Client, q)
+		if err != nil {
+			lastErr = err
+			u.recordFailure(threshold, coolDown)
+			continue
+		}
+
+		u.recordSuccess()
+		return doh.MessageFromAnswer(q, answer), nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("dohproxy: no healthy upstream")
+	}
+
+	return nil, lastErr
+}
+
+func (p *Proxy) doClient(c *doh.Client, q *doh.Question) (*doh.Answer, time.Duration, error) {
+	if p.Timeout <= 0 {
+		return c.Do(q)
+	}
+
+	type result struct {
+		answer *doh.Answer
+		rtt    time.Duration
+		err    error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		answer, rtt, err := c.Do(q)
+		ch <- result{answer, rtt, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.answer, r.rtt, r.err
+	case <-time.After(p.Timeout):
+		return nil, p.Timeout, errors.New("dohproxy: upstream timeout")
+	}
+}
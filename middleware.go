@@ -0,0 +1,53 @@
+package doh
+
+import (
+	"net/http"
+	"time"
+)
+
+// Handler answers a single DNS-over-HTTPS Question. HandlerFunc adapts a
+// plain function to a Handler.
+type Handler interface {
+	Handle(*Question) *Answer
+}
+
+// Middleware wraps a server-side Handler with additional behaviour, such as
+// filtering, query rewriting or logging, without forking Server.
+type Middleware func(next Handler) Handler
+
+// HTTPMiddleware wraps Server itself, for behaviour that needs the
+// underlying *http.Request, such as per-source rate limiting. See
+// Server.Wrap.
+type HTTPMiddleware func(next http.Handler) http.Handler
+
+// ClientHandler executes a DNS-over-HTTPS query, returning the answer, the
+// round-trip time and any error. Client, CachingClient, Validator and Pool
+// all implement it.
+type ClientHandler interface {
+	Do(*Question) (*Answer, time.Duration, error)
+}
+
+// ClientMiddleware wraps a ClientHandler with additional client-side
+// behaviour, such as query rewriting or tracing.
+type ClientMiddleware func(next ClientHandler) ClientHandler
+
+// ChainClient composes a ClientHandler (typically a *Client) with a chain of
+// ClientMiddleware, letting callers insert behaviour without forking Client.
+type ChainClient struct {
+	// Client executes queries once all Middleware has run.
+	Client ClientHandler
+
+	// Middleware is applied, in order, around Client.
+	Middleware []ClientMiddleware
+}
+
+// Do implements ClientHandler.
+func (c *ChainClient) Do(q *Question) (*Answer, time.Duration, error) {
+	h := c.Client
+
+	for i := len(c.Middleware) - 1; i >= 0; i-- {
+		h = c.Middleware[i](h)
+	}
+
+	return h.Do(q)
+}
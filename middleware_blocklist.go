@@ -0,0 +1,31 @@
+package doh
+
+import "strings"
+
+// BlocklistMiddleware returns a Middleware that answers NXDOMAIN, without
+// invoking next, for any query whose name is or is a subdomain of one of
+// suffixes. This is the common case of running your own DoH server for
+// ad/malware filtering.
+func BlocklistMiddleware(suffixes ...string) Middleware {
+	blocked := make([]string, len(suffixes))
+	for i, s := range suffixes {
+		blocked[i] = strings.ToLower(FQDN(s))
+	}
+
+	return func(next Handler) Handler {
+		return HandlerFunc(func(q *Question) *Answer {
+			name := strings.ToLower(FQDN(q.Name))
+
+			for _, suffix := range blocked {
+				if name == suffix || strings.HasSuffix(name, "."+suffix) {
+					return &Answer{
+						Status:   NameError,
+						Question: Questions{q},
+					}
+				}
+			}
+
+			return next.Handle(q)
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package doh
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// logEntry is the shape written, one per line, by LoggingMiddleware.
+type logEntry struct {
+	Question *Question `json:"question"`
+	Answer   *Answer   `json:"answer,omitempty"`
+	Status   string    `json:"status"`
+}
+
+// LoggingMiddleware returns a Middleware that writes one JSON object per
+// request to w, recording the Question and the resulting Answer.
+func LoggingMiddleware(w io.Writer) Middleware {
+	enc := json.NewEncoder(w)
+
+	return func(next Handler) Handler {
+		return HandlerFunc(func(q *Question) *Answer {
+			res := next.Handle(q)
+
+			entry := logEntry{Question: q, Answer: res}
+			if res != nil {
+				entry.Status = res.Status.String()
+			} else {
+				entry.Status = ReturnCode(ServerFailure).String()
+			}
+
+			enc.Encode(entry)
+
+			return res
+		})
+	}
+}
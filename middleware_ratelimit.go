@@ -0,0 +1,66 @@
+package doh
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a simple per-source token bucket, refilled continuously at
+// rate tokens/sec up to burst.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take() bool {
+	now := time.Now()
+	b.tokens += b.rate * now.Sub(b.last).Seconds()
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// RateLimitMiddleware returns an HTTPMiddleware that limits each source IP
+// to rate requests/sec, with bursts up to burst, responding with 429 Too
+// Many Requests once exhausted.
+func RateLimitMiddleware(rate float64, burst int) HTTPMiddleware {
+	var mu sync.Mutex
+	buckets := map[string]*tokenBucket{}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+
+			mu.Lock()
+			b, ok := buckets[host]
+			if !ok {
+				b = &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+				buckets[host] = b
+			}
+			allow := b.take()
+			mu.Unlock()
+
+			if !allow {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package doh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlocklistMiddleware(t *testing.T) {
+	var calledNext bool
+
+	h := BlocklistMiddleware("ads.example.com")(HandlerFunc(func(q *Question) *Answer {
+		calledNext = true
+		return &Answer{Status: Success}
+	}))
+
+	res := h.Handle(&Question{Name: "tracker.ads.example.com."})
+	assert.Equal(t, ReturnCode(NameError), res.Status)
+	assert.False(t, calledNext)
+
+	res = h.Handle(&Question{Name: "example.org."})
+	assert.Equal(t, ReturnCode(Success), res.Status)
+	assert.True(t, calledNext)
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := &tokenBucket{rate: 1, burst: 2, tokens: 2}
+
+	assert.True(t, b.take())
+	assert.True(t, b.take())
+	assert.False(t, b.take())
+}
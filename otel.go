@@ -0,0 +1,42 @@
+// +build otel
+
+package doh
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingMiddleware returns a Middleware that emits an OpenTelemetry span
+// for every request, with question name/type and rcode attributes. Handler
+// carries no context.Context of its own, so each span is a standalone root
+// span rather than a child of the incoming HTTP request's span.
+func TracingMiddleware(tracer trace.Tracer) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(q *Question) *Answer {
+			_, span := tracer.Start(context.Background(), "doh.Handle",
+				trace.WithAttributes(
+					attribute.String("dns.question.name", q.Name),
+					attribute.String("dns.question.type", q.Type.String()),
+				),
+			)
+			defer span.End()
+
+			res := next.Handle(q)
+
+			if res != nil {
+				span.SetAttributes(attribute.String("dns.rcode", res.Status.String()))
+				if res.Status != Success {
+					span.SetStatus(codes.Error, res.Status.String())
+				}
+			} else {
+				span.SetStatus(codes.Error, "nil answer")
+			}
+
+			return res
+		})
+	}
+}
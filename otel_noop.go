@@ -0,0 +1,13 @@
+// +build !otel
+
+package doh
+
+// TracingMiddleware is a no-op unless built with the `otel` build tag, which
+// enables OpenTelemetry span emission via go.opentelemetry.io/otel. This
+// keeps the default build dependency-free, matching marshalJSON /
+// unmarshalJSON's easyjson/stdlib split.
+func TracingMiddleware(tracer interface{}) Middleware {
+	return func(next Handler) Handler {
+		return next
+	}
+}
@@ -0,0 +1,353 @@
+package doh
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaults for Pool's circuit-breaker, mirroring dohproxy's.
+const (
+	defaultPoolFailThreshold = 3
+	defaultPoolCoolDown      = 30 * time.Second
+)
+
+// Strategy selects how a Pool distributes a query across its Upstreams.
+type Strategy int
+
+const (
+	// FirstSuccess queries every healthy upstream concurrently and
+	// returns the first successful answer. This is the default.
+	FirstSuccess Strategy = iota
+
+	// Sequential queries upstreams one at a time, in the order given,
+	// stopping at the first success.
+	Sequential
+
+	// Weighted queries a single upstream, chosen at random and weighted
+	// by PoolUpstream.Weight.
+	Weighted
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case Sequential:
+		return "sequential"
+	case Weighted:
+		return "weighted"
+	default:
+		return "first-success"
+	}
+}
+
+// PoolUpstream is a single Client within a Pool, with its own
+// circuit-breaker state.
+type PoolUpstream struct {
+	// Client queries this upstream.
+	Client *Client
+
+	// Weight influences how often this upstream is chosen under the
+	// Weighted strategy. Defaults to 1.
+	Weight int
+
+	failures  int32
+	downUntil atomic.Value
+}
+
+func (u *PoolUpstream) weight() int {
+	if u.Weight > 0 {
+		return u.Weight
+	}
+
+	return 1
+}
+
+func (u *PoolUpstream) healthy() bool {
+	dt, ok := u.downUntil.Load().(time.Time)
+	return !ok || time.Now().After(dt)
+}
+
+func (u *PoolUpstream) recordSuccess() {
+	atomic.StoreInt32(&u.failures, 0)
+}
+
+func (u *PoolUpstream) recordFailure(threshold int, coolDown time.Duration) {
+	if atomic.AddInt32(&u.failures, 1) >= int32(threshold) {
+		u.downUntil.Store(time.Now().Add(coolDown))
+	}
+}
+
+// Pool queries several DoH upstreams, mirroring how classic stub resolvers
+// try multiple `nameserver` lines from resolv.conf.
+type Pool struct {
+	// Upstreams are the servers to query. Order matters under Sequential.
+	Upstreams []*PoolUpstream
+
+	// Strategy selects how Upstreams are queried. Defaults to
+	// FirstSuccess.
+	Strategy Strategy
+
+	// FailThreshold is the number of consecutive failures before an
+	// upstream is taken out of rotation for CoolDown. Defaults to 3.
+	FailThreshold int
+
+	// CoolDown is how long a failed upstream is skipped before being
+	// retried. Defaults to 30s.
+	CoolDown time.Duration
+
+	// Agree, if non-zero, requires at least this many upstreams to return
+	// an identical Answer.Answer before Do succeeds, regardless of
+	// Strategy. Useful for detecting a compromised or filtering
+	// resolver.
+	Agree int
+
+	// OnServed, if set, is called with the upstream that served a
+	// successful Do, and the RTT it took, for observability.
+	OnServed func(upstream *Client, rtt time.Duration)
+}
+
+// PoolError is returned when a Pool query fails, e.g. because no upstream
+// succeeded or the upstreams failed to agree.
+type PoolError struct {
+	msg string
+	err error
+}
+
+func (pe *PoolError) Error() string {
+	if pe.err != nil {
+		return "pool: " + pe.msg + ": " + pe.err.Error()
+	}
+
+	return "pool: " + pe.msg
+}
+
+// Cause returns the root cause error, or nil if not configured.
+func (pe *PoolError) Cause() error {
+	return pe.err
+}
+
+// Do executes q against Upstreams according to Strategy (or Agree, if set),
+// returning the winning Answer.
+func (p *Pool) Do(q *Question) (*Answer, time.Duration, error) {
+	threshold := p.failThreshold()
+	coolDown := p.coolDown()
+
+	if p.Agree > 0 {
+		return p.doAgree(q, threshold, coolDown)
+	}
+
+	switch p.Strategy {
+	case Sequential:
+		return p.doSequential(q, threshold, coolDown)
+	case Weighted:
+		return p.doWeighted(q, threshold, coolDown)
+	default:
+		return p.doFirstSuccess(q, threshold, coolDown)
+	}
+}
+
+func (p *Pool) healthyUpstreams() []*PoolUpstream {
+	var upstreams []*PoolUpstream
+	for _, u := range p.Upstreams {
+		if u.healthy() {
+			upstreams = append(upstreams, u)
+		}
+	}
+
+	return upstreams
+}
+
+func (p *Pool) failThreshold() int {
+	if p.FailThreshold > 0 {
+		return p.FailThreshold
+	}
+
+	return defaultPoolFailThreshold
+}
+
+func (p *Pool) coolDown() time.Duration {
+	if p.CoolDown > 0 {
+		return p.CoolDown
+	}
+
+	return defaultPoolCoolDown
+}
+
+func (p *Pool) notify(c *Client, rtt time.Duration) {
+	if p.OnServed != nil {
+		p.OnServed(c, rtt)
+	}
+}
+
+func (p *Pool) doSequential(q *Question, threshold int, coolDown time.Duration) (*Answer, time.Duration, error) {
+	var lastErr error
+
+	for _, u := range p.healthyUpstreams() {
+		answer, rtt, err := u.Client.Do(q)
+		if err != nil {
+			lastErr = err
+			u.recordFailure(threshold, coolDown)
+			continue
+		}
+
+		u.recordSuccess()
+		p.notify(u.Client, rtt)
+		return answer, rtt, nil
+	}
+
+	return nil, 0, poolError(lastErr)
+}
+
+func (p *Pool) doWeighted(q *Question, threshold int, coolDown time.Duration) (*Answer, time.Duration, error) {
+	upstreams := p.healthyUpstreams()
+	if len(upstreams) == 0 {
+		return nil, 0, poolError(nil)
+	}
+
+	total := 0
+	for _, u := range upstreams {
+		total += u.weight()
+	}
+
+	pick := rand.Intn(total)
+
+	var chosen *PoolUpstream
+	for _, u := range upstreams {
+		pick -= u.weight()
+		if pick < 0 {
+			chosen = u
+			break
+		}
+	}
+
+	answer, rtt, err := chosen.Client.Do(q)
+	if err != nil {
+		chosen.recordFailure(threshold, coolDown)
+		return nil, rtt, poolError(err)
+	}
+
+	chosen.recordSuccess()
+	p.notify(chosen.Client, rtt)
+	return answer, rtt, nil
+}
+
+type poolResult struct {
+	u      *PoolUpstream
+	answer *Answer
+	rtt    time.Duration
+	err    error
+}
+
+// doFirstSuccess queries every healthy upstream concurrently and returns as
+// soon as one succeeds. The remaining queries are left to finish in the
+// background and their results discarded; Client does not expose a way to
+// cancel an in-flight request.
+func (p *Pool) doFirstSuccess(q *Question, threshold int, coolDown time.Duration) (*Answer, time.Duration, error) {
+	upstreams := p.healthyUpstreams()
+	if len(upstreams) == 0 {
+		return nil, 0, poolError(nil)
+	}
+
+	results := make(chan poolResult, len(upstreams))
+
+	for _, u := range upstreams {
+		u := u
+		go func() {
+			answer, rtt, err := u.Client.Do(q)
+			results <- poolResult{u, answer, rtt, err}
+		}()
+	}
+
+	var lastErr error
+
+	for i := 0; i < len(upstreams); i++ {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			r.u.recordFailure(threshold, coolDown)
+			continue
+		}
+
+		r.u.recordSuccess()
+		p.notify(r.u.Client, r.rtt)
+
+		go drainPoolResults(results, len(upstreams)-i-1)
+
+		return r.answer, r.rtt, nil
+	}
+
+	return nil, 0, poolError(lastErr)
+}
+
+func drainPoolResults(results <-chan poolResult, n int) {
+	for i := 0; i < n; i++ {
+		<-results
+	}
+}
+
+func (p *Pool) doAgree(q *Question, threshold int, coolDown time.Duration) (*Answer, time.Duration, error) {
+	upstreams := p.healthyUpstreams()
+	if len(upstreams) < p.Agree {
+		return nil, 0, &PoolError{msg: "not enough healthy upstreams to satisfy Agree"}
+	}
+
+	responses := make([]poolResult, len(upstreams))
+
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		wg.Add(1)
+		go func(i int, u *PoolUpstream) {
+			defer wg.Done()
+			answer, rtt, err := u.Client.Do(q)
+			responses[i] = poolResult{u, answer, rtt, err}
+		}(i, u)
+	}
+	wg.Wait()
+
+	groups := map[string][]poolResult{}
+	for _, r := range responses {
+		if r.err != nil {
+			r.u.recordFailure(threshold, coolDown)
+			continue
+		}
+
+		r.u.recordSuccess()
+
+		key := recordsKey(r.answer.Answer)
+		groups[key] = append(groups[key], r)
+	}
+
+	for _, group := range groups {
+		if len(group) >= p.Agree {
+			winner := group[0]
+			p.notify(winner.u.Client, winner.rtt)
+			return winner.answer, winner.rtt, nil
+		}
+	}
+
+	return nil, 0, &PoolError{msg: "upstreams did not agree on an answer"}
+}
+
+func poolError(err error) error {
+	if err == nil {
+		return &PoolError{msg: "no healthy upstream"}
+	}
+
+	return &PoolError{msg: "all upstreams failed", err: err}
+}
+
+// recordsKey returns an order-independent string key identifying the record
+// set, for comparing answers from different upstreams.
+func recordsKey(records Records) string {
+	keys := make([]string, len(records))
+	for i, r := range records {
+		keys[i] = r.Name + "|" + r.Type.String() + "|" + r.Data
+	}
+
+	sort.Strings(keys)
+
+	return strings.Join(keys, ",")
+}
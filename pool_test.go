@@ -0,0 +1,48 @@
+package doh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordsKey(t *testing.T) {
+	a := Records{
+		&Record{Name: "example.org.", Type: A, TTL: 300, Data: "93.184.216.34"},
+		&Record{Name: "example.org.", Type: A, TTL: 60, Data: "93.184.216.35"},
+	}
+
+	b := Records{
+		&Record{Name: "example.org.", Type: A, TTL: 12, Data: "93.184.216.35"},
+		&Record{Name: "example.org.", Type: A, TTL: 299, Data: "93.184.216.34"},
+	}
+
+	assert.Equal(t, recordsKey(a), recordsKey(b))
+
+	c := Records{
+		&Record{Name: "example.org.", Type: A, TTL: 300, Data: "93.184.216.99"},
+	}
+
+	assert.NotEqual(t, recordsKey(a), recordsKey(c))
+}
+
+func TestPoolUpstreamCircuitBreaker(t *testing.T) {
+	u := &PoolUpstream{}
+
+	assert.True(t, u.healthy())
+
+	u.recordFailure(2, 0)
+	assert.True(t, u.healthy())
+
+	u.recordFailure(2, 1000*1000*1000) // 1s
+	assert.False(t, u.healthy())
+
+	u.recordSuccess()
+}
+
+func TestPoolDoSequentialNoUpstreams(t *testing.T) {
+	p := &Pool{}
+
+	_, _, err := p.Do(&Question{Name: "example.org.", Type: A})
+	assert.Error(t, err)
+}
@@ -1,28 +1,109 @@
 package doh
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
+
+	"github.com/miekg/dns"
 )
 
+// maxWireMessageSize bounds the size of an application/dns-message POST
+// body accepted by Server, in line with the TCP message length limit.
+const maxWireMessageSize = 65535
+
 // HandlerFunc is given an incoming DNS-over-HTTPS request and is expected to
 // return a response, if the response is nil a ServFail rcode will be returned
 // to the client.
 type HandlerFunc func(*Question) *Answer
 
+// Handle calls f, so that HandlerFunc implements Handler.
+func (f HandlerFunc) Handle(q *Question) *Answer {
+	return f(q)
+}
+
 // Server configures handling of DNS-over-HTTPS requests and exposes a
 // net/http compatible server.
 type Server struct {
-	// Handler is invoked for every valid DNS-over-HTTPS request.
-	Handler HandlerFunc
+	// Handler is invoked for every valid DNS-over-HTTPS request, after
+	// Middleware has been applied. A plain func(*Question) *Answer can be
+	// used here by converting it to a HandlerFunc.
+	Handler Handler
+
+	// Middleware is applied, in order, around Handler.
+	Middleware []Middleware
+
+	// HTTPMiddleware is applied, in order, around the Server itself by
+	// Wrap, for behaviour that needs the underlying *http.Request (such as
+	// per-source rate limiting).
+	HTTPMiddleware []HTTPMiddleware
 
 	// AllowHTTP disables refusing to answer requests that did not come
 	// over HTTPS.
 	AllowHTTP bool
 }
 
+// Wrap returns an http.Handler that applies HTTPMiddleware around s, for
+// mounting with an http.ServeMux or similar.
+func (s *Server) Wrap() http.Handler {
+	var h http.Handler = s
+
+	for i := len(s.HTTPMiddleware) - 1; i >= 0; i-- {
+		h = s.HTTPMiddleware[i](h)
+	}
+
+	return h
+}
+
+func (s *Server) handler() Handler {
+	h := s.Handler
+
+	for i := len(s.Middleware) - 1; i >= 0; i-- {
+		h = s.Middleware[i](h)
+	}
+
+	return h
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Handler == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if r.URL.Scheme != "https" && !s.AllowHTTP {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if requestFormat(r) == WireFormat {
+		s.serveWire(w, r)
+		return
+	}
+
+	s.serveJSON(w, r)
+}
+
+// requestFormat content-negotiates between the legacy application/dns-json
+// protocol and the standardized RFC 8484 application/dns-message protocol.
+func requestFormat(r *http.Request) Format {
+	if strings.Contains(r.Header.Get("Accept"), mimeDNSMessage) {
+		return WireFormat
+	}
+
+	if r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), mimeDNSMessage) {
+		return WireFormat
+	}
+
+	if r.Method == http.MethodGet && r.URL.Query().Get("dns") != "" {
+		return WireFormat
+	}
+
+	return JSONFormat
+}
+
+func (s *Server) serveJSON(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -32,12 +113,6 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else if strings.HasPrefix(r.Header.Get("Accept"), "application/dns-json") {
 		w.WriteHeader(http.StatusUnsupportedMediaType)
 		return
-	} else if s.Handler == nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	} else if r.URL.Scheme != "https" && !s.AllowHTTP {
-		w.WriteHeader(http.StatusForbidden)
-		return
 	}
 
 	req := QuestionFromValues(r.URL.Query())
@@ -50,7 +125,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/dns-json; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 
-	res := s.Handler(&req)
+	res := s.handler().Handle(&req)
 
 	if res == nil {
 		res = &Answer{
@@ -60,3 +135,60 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	json.NewEncoder(w).Encode(res)
 }
+
+func (s *Server) serveWire(w http.ResponseWriter, r *http.Request) {
+	var query []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		enc := r.URL.Query().Get("dns")
+		if enc == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		query, err = base64.RawURLEncoding.DecodeString(enc)
+	case http.MethodPost:
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), mimeDNSMessage) {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		query, err = ioutil.ReadAll(io.LimitReader(r.Body, maxWireMessageSize))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(query); err != nil || len(m.Question) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	req := QuestionFromMessage(m)
+
+	res := s.handler().Handle(&req)
+	if res == nil {
+		res = &Answer{Status: ServerFailure}
+	}
+
+	reply := MessageFromAnswer(&req, res)
+	reply.Id = m.Id
+
+	out, err := reply.Pack()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", mimeDNSMessage)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
@@ -0,0 +1,250 @@
+package doh
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Format selects the wire encoding used between Client/Server and the
+// DNS-over-HTTPS upstream.
+type Format int
+
+const (
+	// JSONFormat speaks the legacy Google/Cloudflare application/dns-json
+	// protocol. This is the default, for backwards compatibility.
+	JSONFormat Format = iota
+
+	// WireFormat speaks the standardized RFC 8484 application/dns-message
+	// protocol, exchanging binary DNS messages.
+	WireFormat
+)
+
+func (f Format) String() string {
+	switch f {
+	case WireFormat:
+		return mimeDNSMessage
+	default:
+		return mimeDNSJSON
+	}
+}
+
+const (
+	mimeDNSMessage = "application/dns-message"
+	mimeDNSJSON    = "application/dns-json"
+)
+
+// MessageFromQuestion builds an outgoing RFC 8484 DNS wire message for the
+// given Question.
+func MessageFromQuestion(q *Question) *dns.Msg {
+	m := new(dns.Msg)
+	m.Id = dns.Id()
+	m.RecursionDesired = true
+	m.CheckingDisabled = q.DisableDNSSEC
+
+	rrtype := uint16(q.Type)
+	if rrtype == 0 {
+		rrtype = dns.TypeA
+	}
+
+	m.Question = []dns.Question{
+		{Name: FQDN(q.Name), Qtype: rrtype, Qclass: dns.ClassINET},
+	}
+
+	if q.EDNSClientSubnet != "" {
+		if subnet := ednsClientSubnet(q.EDNSClientSubnet); subnet != nil {
+			o := new(dns.OPT)
+			o.Hdr.Name = "."
+			o.Hdr.Rrtype = dns.TypeOPT
+			o.SetUDPSize(dns.DefaultMsgSize)
+			o.SetDo(!q.DisableDNSSEC)
+			o.Option = append(o.Option, subnet)
+			m.Extra = append(m.Extra, o)
+		}
+	}
+
+	return m
+}
+
+// QuestionFromMessage extracts the first Question from an incoming RFC 8484
+// DNS wire message.
+func QuestionFromMessage(m *dns.Msg) Question {
+	if len(m.Question) == 0 {
+		return Question{}
+	}
+
+	dq := m.Question[0]
+
+	q := Question{
+		Name:          dq.Name,
+		Type:          RecordType(dq.Qtype),
+		DisableDNSSEC: m.CheckingDisabled,
+	}
+
+	for _, rr := range m.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			for _, o := range opt.Option {
+				if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+					q.EDNSClientSubnet = formatEDNSClientSubnet(subnet, subnet.SourceNetmask)
+				}
+			}
+		}
+	}
+
+	return q
+}
+
+// formatEDNSClientSubnet renders an EDNS0 Client Subnet option as a CIDR
+// string, so the prefix length survives alongside the address.
+func formatEDNSClientSubnet(subnet *dns.EDNS0_SUBNET, mask uint8) string {
+	return fmt.Sprintf("%s/%d", subnet.Address.String(), mask)
+}
+
+func ednsClientSubnet(subnet string) *dns.EDNS0_SUBNET {
+	ip, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		ip = net.ParseIP(subnet)
+		if ip == nil {
+			return nil
+		}
+	}
+
+	e := &dns.EDNS0_SUBNET{
+		Code:    dns.EDNS0SUBNET,
+		Address: ip,
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		e.Family = 1
+		e.SourceNetmask = 32
+	} else {
+		e.Family = 2
+		e.SourceNetmask = 128
+	}
+
+	if ipNet != nil {
+		ones, _ := ipNet.Mask.Size()
+		e.SourceNetmask = uint8(ones)
+	}
+
+	return e
+}
+
+// AnswerFromMessage converts an incoming RFC 8484 DNS wire message into an
+// Answer, mirroring the shape returned by the legacy JSON protocol.
+func AnswerFromMessage(m *dns.Msg) *Answer {
+	a := &Answer{
+		Status:             ReturnCode(m.Rcode),
+		Truncated:          m.Truncated,
+		RecursionDesired:   m.RecursionDesired,
+		RecursionAvailable: m.RecursionAvailable,
+		DNSSECValidated:    m.AuthenticatedData,
+		DNSSECDisabled:     m.CheckingDisabled,
+	}
+
+	for _, q := range m.Question {
+		a.Question = append(a.Question, &Question{
+			Name: q.Name,
+			Type: RecordType(q.Qtype),
+		})
+	}
+
+	a.Answer = recordsFromRRs(m.Answer)
+	a.Authority = recordsFromRRs(m.Ns)
+
+	for _, rr := range m.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			for _, o := range opt.Option {
+				if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+					a.EdnsClientSubnet = formatEDNSClientSubnet(subnet, subnet.SourceScope)
+				}
+			}
+
+			continue
+		}
+
+		a.Additional = append(a.Additional, recordFromRR(rr))
+	}
+
+	return a
+}
+
+// MessageFromAnswer converts an Answer, as returned by a HandlerFunc, back
+// into an outgoing RFC 8484 DNS wire message in reply to q.
+func MessageFromAnswer(q *Question, a *Answer) *dns.Msg {
+	m := new(dns.Msg)
+	m.Response = true
+	m.RecursionDesired = true
+	m.RecursionAvailable = a.RecursionAvailable
+	m.AuthenticatedData = a.DNSSECValidated
+	m.CheckingDisabled = a.DNSSECDisabled
+	m.Truncated = a.Truncated
+	m.Rcode = int(a.Status)
+
+	rrtype := uint16(q.Type)
+	if rrtype == 0 {
+		rrtype = dns.TypeA
+	}
+
+	m.Question = []dns.Question{
+		{Name: FQDN(q.Name), Qtype: rrtype, Qclass: dns.ClassINET},
+	}
+
+	m.Answer = rrsFromRecords(a.Answer)
+	m.Ns = rrsFromRecords(a.Authority)
+	m.Extra = rrsFromRecords(a.Additional)
+
+	return m
+}
+
+func recordsFromRRs(rrs []dns.RR) Records {
+	if len(rrs) == 0 {
+		return nil
+	}
+
+	records := make(Records, 0, len(rrs))
+	for _, rr := range rrs {
+		records = append(records, recordFromRR(rr))
+	}
+
+	return records
+}
+
+func recordFromRR(rr dns.RR) *Record {
+	h := rr.Header()
+
+	// dns.RR.String() renders "name\tttl\tclass\ttype\trdata"; everything
+	// after the fourth tab is the rdata in presentation format, matching
+	// the Data field of the legacy JSON protocol.
+	data := ""
+	if fields := strings.SplitN(rr.String(), "\t", 5); len(fields) == 5 {
+		data = fields[4]
+	}
+
+	return &Record{
+		Name: h.Name,
+		Type: RecordType(h.Rrtype),
+		TTL:  int(h.Ttl),
+		Data: data,
+	}
+}
+
+func rrsFromRecords(records Records) []dns.RR {
+	if len(records) == 0 {
+		return nil
+	}
+
+	rrs := make([]dns.RR, 0, len(records))
+	for _, r := range records {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", FQDN(r.Name), r.TTL, r.Type, r.Data))
+		if err != nil {
+			continue
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
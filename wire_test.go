@@ -0,0 +1,113 @@
+package doh
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMessageAnswerRoundTrip checks that MessageFromAnswer and
+// AnswerFromMessage round-trip every RR type the legacy JSON path handles,
+// so the RFC 8484 wire format carries the same data.
+func TestMessageAnswerRoundTrip(t *testing.T) {
+	q := &Question{Name: "example.org.", Type: A}
+
+	a := &Answer{
+		Status:             Success,
+		RecursionDesired:   true,
+		RecursionAvailable: true,
+		Answer: Records{
+			&Record{Name: "example.org.", Type: A, TTL: 300, Data: "93.184.216.34"},
+			&Record{Name: "example.org.", Type: AAAA, TTL: 300, Data: "2606:2800:220:1:248:1893:25c8:1946"},
+			&Record{Name: "example.org.", Type: MX, TTL: 300, Data: "10 mail.example.org."},
+			&Record{Name: "example.org.", Type: TXT, TTL: 300, Data: "\"hello world\""},
+			&Record{Name: "www.example.org.", Type: CNAME, TTL: 300, Data: "example.org."},
+		},
+		Authority: Records{
+			&Record{Name: "example.org.", Type: NS, TTL: 3600, Data: "ns1.example.org."},
+		},
+	}
+
+	m := MessageFromAnswer(q, a)
+	require.NotNil(t, m)
+
+	got := AnswerFromMessage(m)
+	require.NotNil(t, got)
+
+	assert.Equal(t, a.Status, got.Status)
+	assert.Equal(t, a.RecursionDesired, got.RecursionDesired)
+	assert.Equal(t, a.RecursionAvailable, got.RecursionAvailable)
+	require.Len(t, got.Answer, len(a.Answer))
+
+	for i, want := range a.Answer {
+		assert.Equal(t, want.Name, got.Answer[i].Name)
+		assert.Equal(t, want.Type, got.Answer[i].Type)
+		assert.Equal(t, want.TTL, got.Answer[i].TTL)
+	}
+
+	require.Len(t, got.Authority, len(a.Authority))
+	assert.Equal(t, a.Authority[0].Data, got.Authority[0].Data)
+}
+
+// TestMessageAnswerRoundTripFlags checks the CD/AD/TC flags survive the
+// round trip in both directions.
+func TestMessageAnswerRoundTripFlags(t *testing.T) {
+	q := &Question{Name: "example.org.", Type: A}
+
+	a := &Answer{
+		Status:          Success,
+		Truncated:       true,
+		DNSSECValidated: true,
+		DNSSECDisabled:  true,
+	}
+
+	m := MessageFromAnswer(q, a)
+	assert.True(t, m.Truncated)
+	assert.True(t, m.AuthenticatedData)
+	assert.True(t, m.CheckingDisabled)
+
+	got := AnswerFromMessage(m)
+	assert.True(t, got.Truncated)
+	assert.True(t, got.DNSSECValidated)
+	assert.True(t, got.DNSSECDisabled)
+}
+
+// TestMessageQuestionRoundTripEDNSClientSubnet checks that the EDNS Client
+// Subnet prefix length survives MessageFromQuestion/QuestionFromMessage,
+// and that AnswerFromMessage reports the scope netmask the upstream
+// actually answered for.
+func TestMessageQuestionRoundTripEDNSClientSubnet(t *testing.T) {
+	q := &Question{Name: "example.org.", Type: A, EDNSClientSubnet: "203.0.113.0/24"}
+
+	m := MessageFromQuestion(q)
+
+	got := QuestionFromMessage(m)
+	assert.Equal(t, "203.0.113.0/24", got.EDNSClientSubnet)
+
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	reply.Extra = []dns.RR{&dns.OPT{
+		Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT},
+		Option: []dns.EDNS0{&dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: 24,
+			SourceScope:   20,
+			Address:       net.ParseIP("203.0.113.0"),
+		}},
+	}}
+
+	a := AnswerFromMessage(reply)
+	assert.Equal(t, "203.0.113.0/20", a.EdnsClientSubnet)
+}
+
+func TestMessageFromQuestionDisableDNSSEC(t *testing.T) {
+	m := MessageFromQuestion(&Question{Name: "example.org.", Type: A, DisableDNSSEC: true})
+	assert.True(t, m.CheckingDisabled)
+
+	got := QuestionFromMessage(m)
+	assert.True(t, got.DisableDNSSEC)
+}